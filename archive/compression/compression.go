@@ -0,0 +1,316 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package compression
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"sync"
+
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// Compression is the compression algorithm used for a decompressed stream.
+//
+// Deprecated: prefer registering and looking up a Type through the registry
+// below, which also covers schemes (estargz) that are not a pure
+// decompress/recompress pair.
+type Compression int
+
+const (
+	// Uncompressed represents the uncompressed.
+	Uncompressed Compression = iota
+	// Gzip is gzip compression algorithm.
+	Gzip
+)
+
+// DecompressReadCloser include the stream after decompress and the compress method detected.
+type DecompressReadCloser struct {
+	io.ReadCloser
+	compression Compression
+}
+
+// GetCompression returns the compress method which is used before decompressing.
+func (d *DecompressReadCloser) GetCompression() Compression {
+	return d.compression
+}
+
+// CompressStream returns a WriteCloser which compresses the content written
+// to it using the given Compression and writes it to dest.
+func CompressStream(dest io.Writer, comp Compression) (io.WriteCloser, error) {
+	switch comp {
+	case Uncompressed:
+		return nopWriteCloser{dest}, nil
+	case Gzip:
+		return gzip.NewWriter(dest), nil
+	default:
+		return nil, errors.Errorf("unsupported compression format %d", comp)
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// Compressor writes a compressed stream and, once Close has returned,
+// optionally exposes extra content labels that should be recorded alongside
+// the blob (for example an estargz TOC digest).
+type Compressor interface {
+	io.WriteCloser
+
+	// Labels returns additional labels to apply to the committed content,
+	// or nil if there are none. It must only be called after Close.
+	Labels() map[string]string
+}
+
+// Type is a pluggable, registerable compression scheme usable by
+// diff.Config.CompressionType.
+type Type interface {
+	// MediaType is the canonical media type produced by this Type, e.g.
+	// "application/vnd.oci.image.layer.v1.tar+zstd".
+	MediaType() string
+
+	// ParseMediaType reports whether mediaType should be handled by this
+	// Type, allowing a Type to claim more than one media type (e.g. both
+	// the docker and OCI gzip media types).
+	ParseMediaType(mediaType string) bool
+
+	// Compress returns a Compressor which writes a compressed stream to dest.
+	Compress(dest io.Writer) (Compressor, error)
+
+	// Decompress returns a ReadCloser which decompresses the stream read from r.
+	Decompress(r io.Reader) (io.ReadCloser, error)
+}
+
+var (
+	mu       sync.Mutex
+	registry []Type
+)
+
+// Register adds t to the set of known compression types. It is expected to
+// be called from an init function of the package implementing t.
+func Register(t Type) {
+	mu.Lock()
+	defer mu.Unlock()
+	registry = append(registry, t)
+}
+
+// ByMediaType returns the registered Type that claims mediaType, if any.
+func ByMediaType(mediaType string) (Type, bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	for _, t := range registry {
+		if t.ParseMediaType(mediaType) {
+			return t, true
+		}
+	}
+	return nil, false
+}
+
+func init() {
+	Register(uncompressedType{})
+	Register(gzipType{})
+	Register(zstdType{})
+	Register(estargzType{})
+}
+
+// IsUncompressedType reports whether t is the registered uncompressed Type,
+// i.e. Compress is an identity passthrough. Callers that record a
+// "containerd.io/uncompressed" style label pointing a compressed blob back
+// at its plain digest should skip doing so for this Type, since the
+// compressed and uncompressed digests are identical.
+func IsUncompressedType(t Type) bool {
+	_, ok := t.(uncompressedType)
+	return ok
+}
+
+type simpleCompressor struct {
+	io.WriteCloser
+}
+
+func (simpleCompressor) Labels() map[string]string { return nil }
+
+// uncompressed
+
+type uncompressedType struct{}
+
+func (uncompressedType) MediaType() string { return "application/vnd.oci.image.layer.v1.tar" }
+
+func (uncompressedType) ParseMediaType(mediaType string) bool {
+	switch mediaType {
+	case "application/vnd.oci.image.layer.v1.tar",
+		"application/vnd.docker.image.rootfs.diff.tar":
+		return true
+	}
+	return false
+}
+
+func (uncompressedType) Compress(dest io.Writer) (Compressor, error) {
+	return simpleCompressor{nopWriteCloser{dest}}, nil
+}
+
+func (uncompressedType) Decompress(r io.Reader) (io.ReadCloser, error) {
+	return io.NopCloser(r), nil
+}
+
+// gzip
+
+type gzipType struct{}
+
+func (gzipType) MediaType() string { return "application/vnd.oci.image.layer.v1.tar+gzip" }
+
+func (gzipType) ParseMediaType(mediaType string) bool {
+	switch mediaType {
+	case "application/vnd.oci.image.layer.v1.tar+gzip",
+		"application/vnd.docker.image.rootfs.diff.tar.gzip":
+		return true
+	}
+	return false
+}
+
+func (gzipType) Compress(dest io.Writer) (Compressor, error) {
+	return simpleCompressor{gzip.NewWriter(dest)}, nil
+}
+
+func (gzipType) Decompress(r io.Reader) (io.ReadCloser, error) {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return gr, nil
+}
+
+// zstd
+
+type zstdType struct{}
+
+func (zstdType) MediaType() string { return "application/vnd.oci.image.layer.v1.tar+zstd" }
+
+func (zstdType) ParseMediaType(mediaType string) bool {
+	return mediaType == "application/vnd.oci.image.layer.v1.tar+zstd"
+}
+
+func (zstdType) Compress(dest io.Writer) (Compressor, error) {
+	zw, err := zstd.NewWriter(dest)
+	if err != nil {
+		return nil, err
+	}
+	return simpleCompressor{zw}, nil
+}
+
+func (zstdType) Decompress(r io.Reader) (io.ReadCloser, error) {
+	zr, err := zstd.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return zr.IOReadCloser(), nil
+}
+
+// estargz
+
+const tocDigestLabel = "containerd.io/snapshot/stargz/toc.digest"
+
+type estargzType struct{}
+
+func (estargzType) MediaType() string { return "application/vnd.oci.image.layer.v1.tar+gzip" }
+
+func (estargzType) ParseMediaType(mediaType string) bool {
+	// estargz layers are valid gzip and share the gzip media type; callers
+	// select it explicitly via diff.WithCompressionType rather than via
+	// media type sniffing, so Decompress only needs to handle plain gzip.
+	return false
+}
+
+func (estargzType) Compress(dest io.Writer) (Compressor, error) {
+	pr, pw := io.Pipe()
+	ew := estargz.NewWriter(dest)
+
+	done := make(chan error, 1)
+	go func() {
+		err := ew.AppendTar(pr)
+		if err != nil {
+			// Unblock a Write that's still feeding pw: with AppendTar gone,
+			// nobody else is left to drain pr, and pw.Write would otherwise
+			// block forever.
+			pr.CloseWithError(err)
+		} else {
+			pr.Close()
+		}
+		done <- err
+	}()
+
+	return &estargzCompressor{
+		pw:   pw,
+		pr:   pr,
+		ew:   ew,
+		done: done,
+	}, nil
+}
+
+func (estargzType) Decompress(r io.Reader) (io.ReadCloser, error) {
+	gr, err := gzip.NewReader(bufio.NewReader(r))
+	if err != nil {
+		return nil, err
+	}
+	return gr, nil
+}
+
+type estargzCompressor struct {
+	pw   *io.PipeWriter
+	pr   *io.PipeReader
+	ew   *estargz.Writer
+	done chan error
+
+	closeOnce sync.Once
+	labels    map[string]string
+}
+
+func (c *estargzCompressor) Write(p []byte) (int, error) {
+	return c.pw.Write(p)
+}
+
+func (c *estargzCompressor) Close() error {
+	var retErr error
+	c.closeOnce.Do(func() {
+		if err := c.pw.Close(); err != nil {
+			retErr = err
+			return
+		}
+		if err := <-c.done; err != nil {
+			retErr = err
+			return
+		}
+		tocDgst, err := c.ew.Close()
+		if err != nil {
+			retErr = err
+			return
+		}
+		c.labels = map[string]string{
+			tocDigestLabel: tocDgst.String(),
+		}
+	})
+	return retErr
+}
+
+func (c *estargzCompressor) Labels() map[string]string {
+	return c.labels
+}
@@ -0,0 +1,107 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package compression
+
+import (
+	"archive/tar"
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestByMediaType(t *testing.T) {
+	tests := []struct {
+		mediaType string
+		wantType  Type
+		wantOK    bool
+	}{
+		{mediaType: "application/vnd.oci.image.layer.v1.tar", wantType: uncompressedType{}, wantOK: true},
+		{mediaType: "application/vnd.docker.image.rootfs.diff.tar", wantType: uncompressedType{}, wantOK: true},
+		{mediaType: "application/vnd.oci.image.layer.v1.tar+gzip", wantType: gzipType{}, wantOK: true},
+		{mediaType: "application/vnd.docker.image.rootfs.diff.tar.gzip", wantType: gzipType{}, wantOK: true},
+		{mediaType: "application/vnd.oci.image.layer.v1.tar+zstd", wantType: zstdType{}, wantOK: true},
+		{mediaType: "application/vnd.oci.image.layer.v1.tar+nope", wantOK: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mediaType, func(t *testing.T) {
+			got, ok := ByMediaType(tt.mediaType)
+			if ok != tt.wantOK {
+				t.Fatalf("ok = %v, want %v", ok, tt.wantOK)
+			}
+			if ok && got != tt.wantType {
+				t.Errorf("type = %#v, want %#v", got, tt.wantType)
+			}
+		})
+	}
+}
+
+func TestIsUncompressedType(t *testing.T) {
+	if !IsUncompressedType(uncompressedType{}) {
+		t.Error("IsUncompressedType(uncompressedType{}) = false, want true")
+	}
+	if IsUncompressedType(gzipType{}) {
+		t.Error("IsUncompressedType(gzipType{}) = true, want false")
+	}
+}
+
+// failingWriter always fails, simulating a content-store write erroring out
+// mid-stream.
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("downstream write failed")
+}
+
+// TestEstargzCompressorErrorUnblocksWrite ensures that when estargz's
+// AppendTar goroutine fails (because the destination write fails), it
+// closes its pipe reader with that error instead of just exiting, so a
+// caller blocked inside Write observes the error and returns instead of
+// hanging forever with nobody left to drain the pipe.
+func TestEstargzCompressorErrorUnblocksWrite(t *testing.T) {
+	comp, err := estargzType{}.Compress(failingWriter{})
+	if err != nil {
+		t.Fatalf("Compress() error: %v", err)
+	}
+
+	var tarBuf bytes.Buffer
+	tw := tar.NewWriter(&tarBuf)
+	content := bytes.Repeat([]byte("a"), 64*1024)
+	if err := tw.WriteHeader(&tar.Header{Name: "file", Size: int64(len(content)), Mode: 0644}); err != nil {
+		t.Fatalf("tar WriteHeader() error: %v", err)
+	}
+	if _, err := tw.Write(content); err != nil {
+		t.Fatalf("tar Write() error: %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("tar Close() error: %v", err)
+	}
+
+	writeDone := make(chan error, 1)
+	go func() {
+		_, err := comp.Write(tarBuf.Bytes())
+		writeDone <- err
+	}()
+
+	select {
+	case <-writeDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Write blocked after the downstream writer failed; pipe reader was never closed with the error")
+	}
+}
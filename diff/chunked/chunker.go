@@ -0,0 +1,124 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package chunked
+
+import (
+	"io"
+)
+
+// gearTable holds the 256 per-byte constants used by the gear hash. It is
+// derived deterministically from a fixed seed with a xorshift64* generator
+// so the chunk boundaries (and therefore dedup behavior) are stable across
+// builds and platforms.
+var gearTable = func() (t [256]uint64) {
+	x := uint64(0x2545f4914f6cdd1d)
+	for i := range t {
+		x ^= x >> 12
+		x ^= x << 25
+		x ^= x >> 27
+		x *= 0x2545f4914f6cdd1d
+		t[i] = x
+	}
+	return t
+}()
+
+// Chunker splits a byte stream into content-defined chunks using FastCDC's
+// normalized chunking over a gear hash, so that inserting or removing bytes
+// in the source only perturbs the chunks adjacent to the edit.
+type Chunker struct {
+	r                  io.Reader
+	min, avg, max      int
+	maskSmall, maskBig uint64
+
+	buf []byte
+	eof bool
+}
+
+// NewChunker returns a Chunker reading from r that yields chunks no smaller
+// than minSize and no larger than maxSize, centered around avgSize.
+func NewChunker(r io.Reader, minSize, avgSize, maxSize int) *Chunker {
+	bits := bitLen(avgSize) - 1
+	return &Chunker{
+		r:         r,
+		min:       minSize,
+		avg:       avgSize,
+		max:       maxSize,
+		maskSmall: (uint64(1) << uint(bits+1)) - 1,
+		maskBig:   (uint64(1) << uint(bits-1)) - 1,
+	}
+}
+
+func bitLen(n int) int {
+	l := 0
+	for n > 0 {
+		n >>= 1
+		l++
+	}
+	return l
+}
+
+// Next returns the next chunk of the stream, or io.EOF once the stream has
+// been fully consumed. The returned slice is only valid until the next call
+// to Next.
+func (c *Chunker) Next() ([]byte, error) {
+	for len(c.buf) < c.max && !c.eof {
+		fill := make([]byte, c.max-len(c.buf))
+		n, err := c.r.Read(fill)
+		c.buf = append(c.buf, fill[:n]...)
+		if err != nil {
+			if err == io.EOF {
+				c.eof = true
+				break
+			}
+			return nil, err
+		}
+	}
+	if len(c.buf) == 0 {
+		return nil, io.EOF
+	}
+
+	cut := c.cut(c.buf)
+	chunk := c.buf[:cut]
+	c.buf = c.buf[cut:]
+	return chunk, nil
+}
+
+// cut returns the offset at which data should be split into a chunk,
+// scanning the gear hash for a boundary between min and max bytes.
+func (c *Chunker) cut(data []byte) int {
+	if len(data) <= c.min {
+		return len(data)
+	}
+	if len(data) > c.max {
+		data = data[:c.max]
+	}
+
+	var fp uint64
+	for i := c.min; i < len(data); i++ {
+		fp = (fp << 1) + gearTable[data[i]]
+		if i < c.avg {
+			if fp&c.maskSmall == 0 {
+				return i + 1
+			}
+		} else {
+			if fp&c.maskBig == 0 {
+				return i + 1
+			}
+		}
+	}
+	return len(data)
+}
@@ -0,0 +1,159 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package chunked
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func chunkAll(t *testing.T, data []byte, minSize, avgSize, maxSize int) [][]byte {
+	t.Helper()
+
+	c := NewChunker(bytes.NewReader(data), minSize, avgSize, maxSize)
+	var chunks [][]byte
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next() error: %v", err)
+		}
+		buf := make([]byte, len(chunk))
+		copy(buf, chunk)
+		chunks = append(chunks, buf)
+	}
+	return chunks
+}
+
+func TestChunkerReassemblesInput(t *testing.T) {
+	data := make([]byte, 256*1024)
+	for i := range data {
+		data[i] = byte(i * 7 % 251)
+	}
+
+	chunks := chunkAll(t, data, 4*1024, 16*1024, 64*1024)
+
+	var got bytes.Buffer
+	for _, c := range chunks {
+		got.Write(c)
+	}
+	if !bytes.Equal(got.Bytes(), data) {
+		t.Fatalf("reassembled data does not match input: got %d bytes, want %d", got.Len(), len(data))
+	}
+}
+
+func TestChunkerRespectsMinMax(t *testing.T) {
+	data := make([]byte, 512*1024)
+	for i := range data {
+		data[i] = byte(i % 256)
+	}
+
+	minSize, avgSize, maxSize := 4*1024, 16*1024, 64*1024
+	chunks := chunkAll(t, data, minSize, avgSize, maxSize)
+
+	if len(chunks) == 0 {
+		t.Fatal("expected at least one chunk")
+	}
+	for i, c := range chunks {
+		last := i == len(chunks)-1
+		if len(c) > maxSize {
+			t.Errorf("chunk %d has size %d, exceeds maxSize %d", i, len(c), maxSize)
+		}
+		// the final chunk may be shorter than minSize since it's just
+		// whatever remains of the stream.
+		if !last && len(c) < minSize {
+			t.Errorf("chunk %d has size %d, smaller than minSize %d", i, len(c), minSize)
+		}
+	}
+}
+
+func TestChunkerEmptyInput(t *testing.T) {
+	chunks := chunkAll(t, nil, 1024, 4096, 8192)
+	if len(chunks) != 0 {
+		t.Fatalf("expected no chunks for empty input, got %d", len(chunks))
+	}
+}
+
+func TestChunkerSmallerThanMin(t *testing.T) {
+	data := []byte("short stream shorter than minSize")
+	chunks := chunkAll(t, data, 4096, 8192, 16384)
+	if len(chunks) != 1 {
+		t.Fatalf("expected a single chunk for a stream shorter than minSize, got %d", len(chunks))
+	}
+	if !bytes.Equal(chunks[0], data) {
+		t.Fatalf("chunk content = %q, want %q", chunks[0], data)
+	}
+}
+
+func TestChunkerDeterministic(t *testing.T) {
+	data := make([]byte, 128*1024)
+	for i := range data {
+		data[i] = byte(i * 31 % 256)
+	}
+
+	a := chunkAll(t, data, 4*1024, 16*1024, 64*1024)
+	b := chunkAll(t, data, 4*1024, 16*1024, 64*1024)
+
+	if len(a) != len(b) {
+		t.Fatalf("got %d chunks on first run, %d on second run for identical input", len(a), len(b))
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			t.Fatalf("chunk %d differs between runs", i)
+		}
+	}
+}
+
+func TestChunkerLocalEdit(t *testing.T) {
+	data := make([]byte, 256*1024)
+	for i := range data {
+		data[i] = byte(i * 13 % 256)
+	}
+
+	minSize, avgSize, maxSize := 4*1024, 16*1024, 64*1024
+	before := chunkAll(t, data, minSize, avgSize, maxSize)
+
+	// Insert a handful of bytes roughly in the middle of the stream; a
+	// content-defined chunker should only need to re-cut chunks near the
+	// edit, not the entire tail of the stream.
+	edited := make([]byte, 0, len(data)+8)
+	mid := len(data) / 2
+	edited = append(edited, data[:mid]...)
+	edited = append(edited, []byte("INSERTED")...)
+	edited = append(edited, data[mid:]...)
+
+	after := chunkAll(t, edited, minSize, avgSize, maxSize)
+
+	// Count the chunks of the edited stream that also occur, byte for
+	// byte, among the chunks of the original, and require at least one.
+	unaffected := 0
+	beforeSet := make(map[string]bool, len(before))
+	for _, c := range before {
+		beforeSet[string(c)] = true
+	}
+	for _, c := range after {
+		if beforeSet[string(c)] {
+			unaffected++
+		}
+	}
+	if unaffected == 0 {
+		t.Fatal("expected at least some chunks to be unaffected by a small local edit")
+	}
+}
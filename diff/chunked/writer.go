@@ -0,0 +1,168 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package chunked splits a diff's tar stream into content-defined chunks,
+// storing each chunk as its own content-addressed blob so that identical
+// regions across layers are only ever stored once.
+package chunked
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// MediaTypeManifest is the media type of the manifest produced by Write: a
+// JSON document listing the ordered chunks that make up the original
+// stream.
+const MediaTypeManifest = "application/vnd.containerd.chunked.v1+json"
+
+// ParentLabel is set on every chunk blob, pointing at the digest of the
+// manifest that references it.
+const ParentLabel = "containerd.io/chunked.parent"
+
+// gcRefLabelPrefix is set on the manifest, one label per chunk, so that the
+// garbage collector treats each chunk as reachable for as long as the
+// manifest is.
+const gcRefLabelPrefix = "containerd.io/gc.ref.content.chunk."
+
+// Chunk describes one piece of a chunked blob, as stored in a Manifest.
+type Chunk struct {
+	Offset int64         `json:"offset"`
+	Size   int64         `json:"size"`
+	Digest digest.Digest `json:"digest"`
+}
+
+// Manifest is the JSON payload committed to the content store in place of a
+// monolithic blob; it lists, in order, the chunks that reconstruct the
+// original stream.
+type Manifest struct {
+	Chunks []Chunk `json:"chunks"`
+}
+
+// Write reads src (typically the already-compressed tar stream for a diff,
+// streamed in over a pipe from a producer goroutine), splits it using a
+// content-defined chunker sized by min/avg/maxSize, writes each resulting
+// chunk to store as its own content-addressed blob labeled with
+// extraLabels, and returns the resulting Manifest.
+//
+// src is a *io.PipeReader rather than a plain io.Reader so that on any
+// error Write can close it with that error: this unblocks the paired
+// io.PipeWriter's in-flight Write call in the producer goroutine instead of
+// leaving it blocked forever with nobody left to drain the pipe.
+//
+// Write does not commit the manifest itself; the caller is expected to do
+// so via the same content-store commit path used for non-chunked diffs, and
+// should apply LabelChunks afterwards so each chunk records the manifest
+// that references it.
+func Write(ctx context.Context, store content.Store, src *io.PipeReader, minSize, avgSize, maxSize int, extraLabels map[string]string) (Manifest, error) {
+	chunker := NewChunker(src, minSize, avgSize, maxSize)
+
+	var manifest Manifest
+	var offset int64
+	for {
+		chunk, err := chunker.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			src.CloseWithError(err)
+			return Manifest{}, errors.Wrap(err, "failed to read chunk")
+		}
+
+		dgst := digest.FromBytes(chunk)
+		ref := fmt.Sprintf("chunked-%s", dgst)
+		desc := ocispec.Descriptor{
+			Digest: dgst,
+			Size:   int64(len(chunk)),
+		}
+
+		err = content.WriteBlob(ctx, store, ref, bytes.NewReader(chunk), desc, content.WithLabels(extraLabels))
+		if err != nil && !errdefs.IsAlreadyExists(err) {
+			err = errors.Wrapf(err, "failed to write chunk %s", dgst)
+			src.CloseWithError(err)
+			return Manifest{}, err
+		}
+
+		manifest.Chunks = append(manifest.Chunks, Chunk{
+			Offset: offset,
+			Size:   int64(len(chunk)),
+			Digest: dgst,
+		})
+		offset += int64(len(chunk))
+	}
+
+	return manifest, nil
+}
+
+// LabelChunks records manifestDigest as each chunk's parent, along with
+// extraLabels (typically the containerd.io/uncompressed digest of the
+// stream the chunks were cut from, which — unlike ParentLabel — can't be
+// known until the whole stream has been hashed), and the reverse gc.ref
+// edges on the manifest itself, after the manifest has been committed and
+// its final digest is known.
+func LabelChunks(ctx context.Context, store content.Store, manifest Manifest, manifestDigest digest.Digest, extraLabels map[string]string) error {
+	manifestInfo, err := store.Info(ctx, manifestDigest)
+	if err != nil {
+		return errors.Wrap(err, "failed to get manifest info")
+	}
+	if manifestInfo.Labels == nil {
+		manifestInfo.Labels = make(map[string]string)
+	}
+
+	var fields []string
+	for i, chunk := range manifest.Chunks {
+		manifestInfo.Labels[fmt.Sprintf("%s%d", gcRefLabelPrefix, i)] = chunk.Digest.String()
+		fields = append(fields, fmt.Sprintf("labels.%s%d", gcRefLabelPrefix, i))
+
+		chunkInfo, err := store.Info(ctx, chunk.Digest)
+		if err != nil {
+			return errors.Wrapf(err, "failed to get chunk info for %s", chunk.Digest)
+		}
+		if chunkInfo.Labels == nil {
+			chunkInfo.Labels = make(map[string]string)
+		}
+		chunkInfo.Labels[ParentLabel] = manifestDigest.String()
+		chunkFields := []string{"labels." + ParentLabel}
+		for k, v := range extraLabels {
+			chunkInfo.Labels[k] = v
+			chunkFields = append(chunkFields, "labels."+k)
+		}
+		if _, err := store.Update(ctx, chunkInfo, chunkFields...); err != nil {
+			return errors.Wrapf(err, "failed to label chunk %s", chunk.Digest)
+		}
+	}
+
+	if len(fields) > 0 {
+		if _, err := store.Update(ctx, manifestInfo, fields...); err != nil {
+			return errors.Wrap(err, "failed to label manifest")
+		}
+	}
+	return nil
+}
+
+// Marshal serializes the manifest to its on-disk JSON form.
+func (m Manifest) Marshal() ([]byte, error) {
+	return json.Marshal(m)
+}
@@ -0,0 +1,65 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package chunked
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/pkg/errors"
+)
+
+// failingStore is a content.Store whose Writer always fails, used to
+// exercise Write's error path without a real content store.
+type failingStore struct {
+	content.Store
+}
+
+func (failingStore) Writer(ctx context.Context, opts ...content.WriterOpt) (content.Writer, error) {
+	return nil, errors.New("store unavailable")
+}
+
+// TestWriteStoreErrorUnblocksProducer ensures that when the content store
+// rejects a chunk, Write closes its pipe reader with that error instead of
+// just returning, so a producer blocked writing into the paired
+// io.PipeWriter observes the error and unblocks instead of hanging forever.
+func TestWriteStoreErrorUnblocksProducer(t *testing.T) {
+	pr, pw := io.Pipe()
+
+	producerDone := make(chan error, 1)
+	go func() {
+		_, err := pw.Write(make([]byte, 1<<20))
+		producerDone <- err
+	}()
+
+	_, err := Write(context.Background(), failingStore{}, pr, 1024, 4096, 8192, nil)
+	if err == nil {
+		t.Fatal("expected Write to return an error")
+	}
+
+	select {
+	case perr := <-producerDone:
+		if perr == nil {
+			t.Fatal("expected the blocked producer Write to observe an error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("producer goroutine is still blocked on pw.Write after Write returned")
+	}
+}
@@ -0,0 +1,218 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package diff
+
+import (
+	"context"
+	"io"
+
+	"github.com/containerd/containerd/archive/compression"
+	"github.com/containerd/containerd/mount"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Comparer allows the comparison of two mounts to create a content
+// addressable diff of the two mounts. A Comparer is expected to compute
+// the diff between the two mounts and write the bytes to the given
+// writer.
+type Comparer interface {
+	// Compare computes the difference between two mounts and returns a
+	// descriptor for a media object containing the content to be used as
+	// the diff.
+	Compare(ctx context.Context, lower, upper []mount.Mount, opts ...Opt) (ocispec.Descriptor, error)
+}
+
+// Compressor is used to compress a diff stream, returning the compressed
+// writer which the caller must close once the diff has been fully written.
+type Compressor func(dest io.Writer, mediaType string) (io.WriteCloser, error)
+
+// Config is used to hold parameters needed for a diff operation.
+type Config struct {
+	// MediaType is the type of diff to generate
+	// The default is to generate a gzipped tar differ.
+	MediaType string
+
+	// CompressionType requests a specific registered compression.Type be
+	// used to produce the diff rather than the built-in gzip handling.
+	// When Compressor is also set, Compressor is used and CompressionType
+	// is ignored. MediaType is derived from the selected type unless
+	// explicitly overridden.
+	CompressionType compression.Type
+
+	// ForceCompression is used to force compression of the diff, even if
+	// a blob already exists in the content store for the requested
+	// media type's uncompressed digest.
+	ForceCompression bool
+
+	// Reference is the content upload reference used when creating a
+	// new content.Writer.
+	Reference string
+
+	// Labels are the labels to apply to the generated content
+	Labels map[string]string
+
+	// Compressor is used to compress the output stream, rather than
+	// using the default gzip compressor. When used, the Config.MediaType
+	// must be set, as the differ does not know what compression
+	// algorithm is being used.
+	//
+	// This is mutually exclusive with CompressionType, which should be
+	// preferred for new callers.
+	Compressor Compressor
+
+	// Chunking requests that the generated diff be split into
+	// content-defined chunks, each stored as its own blob, rather than as
+	// a single monolithic blob. See WithChunking.
+	Chunking *ChunkingConfig
+
+	// Progress, if set, is called periodically while the diff is being
+	// generated, and once more after it completes. See WithProgress.
+	Progress Progress
+}
+
+// Opt is used to configure a diff operation.
+type Opt func(*Config) error
+
+// ProgressUpdate reports how far an in-flight Compare has gotten.
+//
+// BytesWalked and BytesWrittenPreCompression both measure the uncompressed
+// tar stream and will typically track each other closely; they are reported
+// separately because a Comparer that supports sparse or partial walks may
+// walk more (or less) than it ultimately writes.
+type ProgressUpdate struct {
+	// BytesWalked is the amount of data walked from the mounts so far,
+	// measured as bytes of the uncompressed tar stream.
+	BytesWalked int64
+
+	// BytesWrittenPreCompression is the size of the tar stream produced
+	// so far, before compression.
+	BytesWrittenPreCompression int64
+
+	// BytesWrittenPostCompression is the number of bytes written to the
+	// content store so far, after compression.
+	BytesWrittenPostCompression int64
+
+	// FilesAdded, FilesChanged and FilesDeleted count tar entries seen so
+	// far that are new in upper, modified from lower, and deleted
+	// (whiteout) respectively.
+	FilesAdded   int
+	FilesChanged int
+	FilesDeleted int
+
+	// CurrentPath is the path of the entry most recently written to the
+	// diff.
+	CurrentPath string
+}
+
+// Progress is called with the latest ProgressUpdate for an in-flight
+// Compare.
+type Progress func(ProgressUpdate)
+
+// ChunkingConfig holds the size parameters for content-defined chunking, as
+// set by WithChunking.
+type ChunkingConfig struct {
+	// MinSize is the minimum size of a chunk, in bytes.
+	MinSize int
+
+	// AvgSize is the target average size of a chunk, in bytes.
+	AvgSize int
+
+	// MaxSize is the maximum size of a chunk, in bytes.
+	MaxSize int
+}
+
+// WithMediaType overrides the output mediatype for the diff.
+func WithMediaType(m string) Opt {
+	return func(c *Config) error {
+		c.MediaType = m
+		return nil
+	}
+}
+
+// WithReference is used to set the content upload reference used by
+// the diff operation.
+func WithReference(ref string) Opt {
+	return func(c *Config) error {
+		c.Reference = ref
+		return nil
+	}
+}
+
+// WithLabels is used to set content labels on the generated content.
+func WithLabels(labels map[string]string) Opt {
+	return func(c *Config) error {
+		c.Labels = labels
+		return nil
+	}
+}
+
+// WithCompressor sets the compressor to use for the diff, instead of the
+// default gzip compressor.
+func WithCompressor(comp Compressor) Opt {
+	return func(c *Config) error {
+		c.Compressor = comp
+		return nil
+	}
+}
+
+// WithCompressionType sets the registered compression.Type to use to
+// produce the diff, such as zstd or estargz.
+func WithCompressionType(t compression.Type) Opt {
+	return func(c *Config) error {
+		c.CompressionType = t
+		return nil
+	}
+}
+
+// WithChunking splits the generated diff into content-defined chunks of
+// roughly avgSize bytes (never smaller than minSize or larger than
+// maxSize), each stored as its own blob in the content store. This allows
+// identical regions across layers to be stored once and enables later
+// partial fetches of a layer. The returned descriptor's content is a
+// chunked.Manifest rather than a raw layer blob; see package
+// diff/chunked.
+func WithChunking(minSize, avgSize, maxSize int) Opt {
+	return func(c *Config) error {
+		c.Chunking = &ChunkingConfig{
+			MinSize: minSize,
+			AvgSize: avgSize,
+			MaxSize: maxSize,
+		}
+		return nil
+	}
+}
+
+// WithProgress registers a callback that is invoked periodically while the
+// diff is generated, and once more after it finishes, with the latest
+// ProgressUpdate.
+func WithProgress(onUpdate Progress) Opt {
+	return func(c *Config) error {
+		c.Progress = onUpdate
+		return nil
+	}
+}
+
+// WithForceCompression forces the differ to always produce a freshly
+// compressed blob in the requested media type, even if the content store
+// already holds a blob for this digest from a previous conversion of the
+// same layer to a different compression.
+func WithForceCompression() Opt {
+	return func(c *Config) error {
+		c.ForceCompression = true
+		return nil
+	}
+}
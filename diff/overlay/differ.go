@@ -0,0 +1,416 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package overlay
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/containerd/containerd/archive/compression"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/diff"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/continuity/fs"
+	"github.com/containerd/continuity/sysx"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// whiteout markers used by overlayfs and recognized by the OCI tar format.
+const (
+	whiteoutPrefix     = ".wh."
+	whiteoutOpaqueDir  = whiteoutPrefix + ".wh..opq"
+	opaqueXattr        = "trusted.overlay.opaque"
+	overlayXattrPrefix = "trusted.overlay."
+	paxSchilyXattr     = "SCHILY.xattr."
+)
+
+var emptyDesc = ocispec.Descriptor{}
+var uncompressed = "containerd.io/uncompressed"
+
+type overlayDiff struct {
+	store content.Store
+}
+
+// NewOverlayDiff returns a diff.Comparer which, when both sides of the
+// compare share the same overlayfs lowerdirs, produces the diff by reading
+// the upperdir directly rather than mounting and walking both sides.
+//
+// When the mounts are not overlayfs, or the lowerdirs don't line up, Compare
+// returns an error wrapping errdefs.ErrNotImplemented so that callers can
+// fall back to a generic differ such as walking.NewWalkingDiff.
+func NewOverlayDiff(store content.Store) diff.Comparer {
+	return &overlayDiff{
+		store: store,
+	}
+}
+
+// Compare writes the contents of upper's upperdir as the diff against lower,
+// uploading the result to the content store. lower's own upperdir, if it has
+// one, is not read.
+func (s *overlayDiff) Compare(ctx context.Context, lower, upper []mount.Mount, opts ...diff.Opt) (d ocispec.Descriptor, err error) {
+	var config diff.Config
+	for _, opt := range opts {
+		if err := opt(&config); err != nil {
+			return emptyDesc, err
+		}
+	}
+
+	upperdir, err := getUpperdir(lower, upper)
+	if err != nil {
+		return emptyDesc, errors.Wrap(errdefs.ErrNotImplemented, err.Error())
+	}
+
+	if config.MediaType == "" {
+		config.MediaType = ocispec.MediaTypeImageLayerGzip
+	}
+
+	var isCompressed bool
+	switch config.MediaType {
+	case ocispec.MediaTypeImageLayer:
+	case ocispec.MediaTypeImageLayerGzip:
+		isCompressed = true
+	default:
+		return emptyDesc, errors.Wrapf(errdefs.ErrNotImplemented, "unsupported diff media type: %v", config.MediaType)
+	}
+
+	var newReference bool
+	if config.Reference == "" {
+		newReference = true
+		config.Reference = uniqueRef()
+	}
+
+	cw, err := s.store.Writer(ctx,
+		content.WithRef(config.Reference),
+		content.WithDescriptor(ocispec.Descriptor{
+			MediaType: config.MediaType,
+		}))
+	if err != nil {
+		return emptyDesc, errors.Wrap(err, "failed to open writer")
+	}
+
+	var errOpen error
+	defer func() {
+		if errOpen != nil {
+			cw.Close()
+			if newReference {
+				if abortErr := s.store.Abort(ctx, config.Reference); abortErr != nil {
+					log.G(ctx).WithError(abortErr).WithField("ref", config.Reference).Warnf("failed to delete diff upload")
+				}
+			}
+		}
+	}()
+	if !newReference {
+		if errOpen = cw.Truncate(0); errOpen != nil {
+			return emptyDesc, errOpen
+		}
+	}
+
+	var out io.Writer = cw
+	dgstr := digest.SHA256.Digester()
+	var compressed io.WriteCloser
+	if isCompressed {
+		compressed, errOpen = compression.CompressStream(cw, compression.Gzip)
+		if errOpen != nil {
+			return emptyDesc, errors.Wrap(errOpen, "failed to get compressed stream")
+		}
+		out = io.MultiWriter(compressed, dgstr.Hash())
+	} else {
+		out = io.MultiWriter(cw, dgstr.Hash())
+	}
+
+	errOpen = writeUpperdirDiff(ctx, out, upperdir)
+	if isCompressed {
+		compressed.Close()
+	}
+	if errOpen != nil {
+		return emptyDesc, errors.Wrap(errOpen, "failed to write upperdir diff")
+	}
+
+	if config.Labels == nil {
+		config.Labels = map[string]string{}
+	}
+	if isCompressed {
+		config.Labels[uncompressed] = dgstr.Digest().String()
+	}
+
+	var commitopts []content.Opt
+	if config.Labels != nil {
+		commitopts = append(commitopts, content.WithLabels(config.Labels))
+	}
+
+	dgst := cw.Digest()
+	if errOpen = cw.Commit(ctx, 0, dgst, commitopts...); errOpen != nil {
+		if !errdefs.IsAlreadyExists(errOpen) {
+			return emptyDesc, errors.Wrap(errOpen, "failed to commit")
+		}
+		errOpen = nil
+	}
+
+	info, err := s.store.Info(ctx, dgst)
+	if err != nil {
+		return emptyDesc, errors.Wrap(err, "failed to get info from content store")
+	}
+
+	return ocispec.Descriptor{
+		MediaType: config.MediaType,
+		Size:      info.Size,
+		Digest:    info.Digest,
+	}, nil
+}
+
+// getUpperdir confirms that lower and upper are both single overlayfs mounts
+// sharing the same lowerdirs and, if so, returns upper's upperdir. Any other
+// shape (bind mounts, mismatched lowerdirs, multiple mounts, ...) is reported
+// as an error so the caller can fall back to a generic differ.
+func getUpperdir(lower, upper []mount.Mount) (string, error) {
+	if len(upper) != 1 || upper[0].Type != "overlay" {
+		return "", errors.New("upper is not a single overlay mount")
+	}
+	upperLower, upperdir, ok := parseOverlay(upper[0])
+	if !ok || upperdir == "" {
+		return "", errors.New("upper overlay mount has no upperdir")
+	}
+
+	var lowerLower []string
+	if len(lower) == 0 {
+		// no lower, upper is the first layer: nothing to compare against,
+		// the whole upperdir is the diff.
+	} else if len(lower) == 1 && lower[0].Type == "overlay" {
+		lowerLower, _, ok = parseOverlay(lower[0])
+		if !ok {
+			return "", errors.New("lower is not a valid overlay mount")
+		}
+	} else {
+		return "", errors.New("lower is not a single overlay mount")
+	}
+
+	if !sameLowerdirs(upperLower, lowerLower) {
+		return "", errors.New("lower and upper overlay mounts do not share lowerdirs")
+	}
+	return upperdir, nil
+}
+
+func parseOverlay(m mount.Mount) (lowerdirs []string, upperdir string, ok bool) {
+	if m.Type != "overlay" {
+		return nil, "", false
+	}
+	for _, o := range m.Options {
+		if strings.HasPrefix(o, "lowerdir=") {
+			lowerdirs = strings.Split(strings.TrimPrefix(o, "lowerdir="), ":")
+		} else if strings.HasPrefix(o, "upperdir=") {
+			upperdir = strings.TrimPrefix(o, "upperdir=")
+		}
+	}
+	return lowerdirs, upperdir, true
+}
+
+func sameLowerdirs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// writeUpperdirDiff walks upperdir directly and writes a tar stream of its
+// contents to w, translating overlayfs whiteouts and opaque directories into
+// their OCI tar equivalents along the way.
+func writeUpperdirDiff(ctx context.Context, w io.Writer, upperdir string) error {
+	tw := tar.NewWriter(w)
+	defer tw.Close()
+
+	// seenInodes maps an already-written file's inode number to the tar
+	// name it was written under, so that later walk entries sharing the
+	// same inode are emitted as tar.TypeLink instead of duplicating the
+	// file's content for every hardlink.
+	seenInodes := make(map[uint64]string)
+
+	return filepath.Walk(upperdir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == upperdir {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(upperdir, path)
+		if err != nil {
+			return err
+		}
+
+		if isWhiteout(info) {
+			return writeSimpleHeader(tw, filepath.Join(filepath.Dir(rel), whiteoutPrefix+filepath.Base(rel)))
+		}
+
+		if info.IsDir() {
+			opaque, err := isOpaque(path)
+			if err != nil {
+				return err
+			}
+			if opaque {
+				if err := writeEntry(tw, rel, path, info, seenInodes); err != nil {
+					return err
+				}
+				return writeSimpleHeader(tw, filepath.Join(rel, whiteoutOpaqueDir))
+			}
+		}
+
+		return writeEntry(tw, rel, path, info, seenInodes)
+	})
+}
+
+// writeSimpleHeader writes a zero-length regular file entry, used for
+// whiteout and opaque-directory markers which carry no content of their own.
+func writeSimpleHeader(tw *tar.Writer, name string) error {
+	return tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     0,
+		Mode:     0600,
+	})
+}
+
+// writeEntry writes the tar header and, for regular files, the content of
+// the file at path into tw, preserving ownership, times and xattrs via
+// continuity/fs. seenInodes is consulted and updated so that a path sharing
+// an already-written file's inode number is written as a tar.TypeLink instead
+// of a second copy of the content.
+func writeEntry(tw *tar.Writer, name, path string, info os.FileInfo, seenInodes map[uint64]string) error {
+	var link string
+	if info.Mode()&os.ModeSymlink != 0 {
+		var err error
+		if link, err = os.Readlink(path); err != nil {
+			return err
+		}
+	}
+
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+
+	if sys, ok := info.Sys().(*syscall.Stat_t); ok && sys != nil {
+		hdr.Uid = int(sys.Uid)
+		hdr.Gid = int(sys.Gid)
+	}
+
+	if info.Mode()&os.ModeSymlink == 0 {
+		if ino, isHardlink := fs.GetLinkInfo(info); isHardlink {
+			if oldpath, ok := seenInodes[ino]; ok {
+				hdr.Typeflag = tar.TypeLink
+				hdr.Linkname = oldpath
+				hdr.Size = 0
+			} else {
+				seenInodes[ino] = name
+			}
+		}
+	}
+
+	xattrs, err := fs.Lgetxattrs(path)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get xattrs for %s", path)
+	}
+	for k, v := range filterOverlayXattrs(xattrs) {
+		if hdr.PAXRecords == nil {
+			hdr.PAXRecords = make(map[string]string, len(xattrs))
+		}
+		hdr.PAXRecords[paxSchilyXattr+k] = v
+	}
+
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+
+	if hdr.Typeflag == tar.TypeReg && info.Mode().IsRegular() {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if _, err := io.Copy(tw, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// filterOverlayXattrs drops overlayfs-kernel-internal xattrs (the opaque
+// marker, redirects, origin/metacopy/impure state, ...) from xattrs: they
+// have no meaning outside this upperdir, and the opaque case is already
+// represented by the dedicated whiteout file writeUpperdirDiff emits, so
+// they shouldn't leak into the portable layer as PAX records.
+func filterOverlayXattrs(xattrs map[string]string) map[string]string {
+	filtered := make(map[string]string, len(xattrs))
+	for k, v := range xattrs {
+		if strings.HasPrefix(k, overlayXattrPrefix) {
+			continue
+		}
+		filtered[k] = v
+	}
+	return filtered
+}
+
+// isWhiteout reports whether info describes an overlayfs whiteout marker: a
+// character device with device number 0/0.
+func isWhiteout(info os.FileInfo) bool {
+	sys, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || sys == nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0 && sys.Rdev == uint64(unix.Mkdev(0, 0))
+}
+
+func isOpaque(path string) (bool, error) {
+	v, err := sysx.Lgetxattr(path, opaqueXattr)
+	if err != nil {
+		if errors.Is(err, unix.ENODATA) || errors.Is(err, unix.ENOTSUP) {
+			return false, nil
+		}
+		return false, err
+	}
+	return string(v) == "y", nil
+}
+
+func uniqueRef() string {
+	t := time.Now()
+	var b [3]byte
+	// Ignore read failures, just decreases uniqueness
+	rand.Read(b[:])
+	return fmt.Sprintf("%d-%s", t.UnixNano(), base64.URLEncoding.EncodeToString(b[:]))
+}
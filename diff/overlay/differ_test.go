@@ -0,0 +1,235 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package overlay
+
+import (
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/mount"
+	"golang.org/x/sys/unix"
+)
+
+func TestParseOverlay(t *testing.T) {
+	tests := []struct {
+		name          string
+		mount         mount.Mount
+		wantLowerdirs []string
+		wantUpperdir  string
+		wantOK        bool
+	}{
+		{
+			name:   "not overlay",
+			mount:  mount.Mount{Type: "bind", Options: []string{"lowerdir=/a", "upperdir=/b"}},
+			wantOK: false,
+		},
+		{
+			name:          "lower and upper",
+			mount:         mount.Mount{Type: "overlay", Options: []string{"lowerdir=/a:/b", "upperdir=/c", "workdir=/d"}},
+			wantLowerdirs: []string{"/a", "/b"},
+			wantUpperdir:  "/c",
+			wantOK:        true,
+		},
+		{
+			name:          "lower only",
+			mount:         mount.Mount{Type: "overlay", Options: []string{"lowerdir=/a"}},
+			wantLowerdirs: []string{"/a"},
+			wantUpperdir:  "",
+			wantOK:        true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lowerdirs, upperdir, ok := parseOverlay(tt.mount)
+			if ok != tt.wantOK {
+				t.Fatalf("ok = %v, want %v", ok, tt.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if upperdir != tt.wantUpperdir {
+				t.Errorf("upperdir = %q, want %q", upperdir, tt.wantUpperdir)
+			}
+			if len(lowerdirs) != len(tt.wantLowerdirs) {
+				t.Fatalf("lowerdirs = %v, want %v", lowerdirs, tt.wantLowerdirs)
+			}
+			for i := range lowerdirs {
+				if lowerdirs[i] != tt.wantLowerdirs[i] {
+					t.Errorf("lowerdirs[%d] = %q, want %q", i, lowerdirs[i], tt.wantLowerdirs[i])
+				}
+			}
+		})
+	}
+}
+
+func TestGetUpperdir(t *testing.T) {
+	upper := mount.Mount{Type: "overlay", Options: []string{"lowerdir=/a:/b", "upperdir=/upper"}}
+
+	tests := []struct {
+		name       string
+		lower      []mount.Mount
+		upper      []mount.Mount
+		wantDir    string
+		wantErrStr string
+	}{
+		{
+			name:       "no lower, first layer",
+			lower:      nil,
+			upper:      []mount.Mount{{Type: "overlay", Options: []string{"upperdir=/upper"}}},
+			wantDir:    "/upper",
+			wantErrStr: "",
+		},
+		{
+			name:       "matching lowerdirs",
+			lower:      []mount.Mount{{Type: "overlay", Options: []string{"lowerdir=/a:/b"}}},
+			upper:      []mount.Mount{upper},
+			wantDir:    "/upper",
+			wantErrStr: "",
+		},
+		{
+			name:       "mismatched lowerdirs",
+			lower:      []mount.Mount{{Type: "overlay", Options: []string{"lowerdir=/a"}}},
+			upper:      []mount.Mount{upper},
+			wantErrStr: "do not share lowerdirs",
+		},
+		{
+			name:       "upper is not overlay",
+			lower:      nil,
+			upper:      []mount.Mount{{Type: "bind"}},
+			wantErrStr: "not a single overlay mount",
+		},
+		{
+			name:       "multiple upper mounts",
+			lower:      nil,
+			upper:      []mount.Mount{upper, upper},
+			wantErrStr: "not a single overlay mount",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := getUpperdir(tt.lower, tt.upper)
+			if tt.wantErrStr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if dir != tt.wantDir {
+					t.Errorf("dir = %q, want %q", dir, tt.wantDir)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("expected error containing %q, got nil", tt.wantErrStr)
+			}
+			if !strings.Contains(err.Error(), tt.wantErrStr) {
+				t.Errorf("error = %q, want it to contain %q", err.Error(), tt.wantErrStr)
+			}
+		})
+	}
+}
+
+// fakeFileInfo is a minimal os.FileInfo for exercising isWhiteout without a
+// real overlayfs mount.
+type fakeFileInfo struct {
+	mode os.FileMode
+	sys  interface{}
+}
+
+func (f fakeFileInfo) Name() string       { return "" }
+func (f fakeFileInfo) Size() int64        { return 0 }
+func (f fakeFileInfo) Mode() os.FileMode  { return f.mode }
+func (f fakeFileInfo) ModTime() time.Time { return time.Time{} }
+func (f fakeFileInfo) IsDir() bool        { return f.mode.IsDir() }
+func (f fakeFileInfo) Sys() interface{}   { return f.sys }
+
+func TestIsWhiteout(t *testing.T) {
+	tests := []struct {
+		name string
+		info os.FileInfo
+		want bool
+	}{
+		{
+			name: "char device with 0/0 rdev is a whiteout",
+			info: fakeFileInfo{mode: os.ModeCharDevice, sys: &syscall.Stat_t{Rdev: uint64(unix.Mkdev(0, 0))}},
+			want: true,
+		},
+		{
+			name: "char device with other rdev is not a whiteout",
+			info: fakeFileInfo{mode: os.ModeCharDevice, sys: &syscall.Stat_t{Rdev: uint64(unix.Mkdev(1, 3))}},
+			want: false,
+		},
+		{
+			name: "regular file is not a whiteout",
+			info: fakeFileInfo{mode: 0, sys: &syscall.Stat_t{}},
+			want: false,
+		},
+		{
+			name: "missing Stat_t is not a whiteout",
+			info: fakeFileInfo{mode: os.ModeCharDevice, sys: nil},
+			want: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isWhiteout(tt.info); got != tt.want {
+				t.Errorf("isWhiteout() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsOpaqueNoXattr(t *testing.T) {
+	dir := t.TempDir()
+
+	opaque, err := isOpaque(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if opaque {
+		t.Errorf("isOpaque() = true for a directory with no opaque xattr set")
+	}
+}
+
+func TestFilterOverlayXattrs(t *testing.T) {
+	in := map[string]string{
+		"trusted.overlay.opaque":   "y",
+		"trusted.overlay.redirect": "foo",
+		"trusted.overlay.origin":   "",
+		"security.capability":      "cap",
+		"user.comment":             "hello",
+	}
+
+	got := filterOverlayXattrs(in)
+
+	want := map[string]string{
+		"security.capability": "cap",
+		"user.comment":        "hello",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("filterOverlayXattrs() = %v, want %v", got, want)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("filterOverlayXattrs()[%q] = %q, want %q", k, got[k], v)
+		}
+	}
+}
@@ -23,12 +23,14 @@ import (
 	"io"
 	"math/rand"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/containerd/containerd/archive"
 	"github.com/containerd/containerd/archive/compression"
 	"github.com/containerd/containerd/content"
 	"github.com/containerd/containerd/diff"
+	"github.com/containerd/containerd/diff/chunked"
 	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/mount"
@@ -38,12 +40,17 @@ import (
 )
 
 type walkingDiff struct {
-	store content.Store
+	store     content.Store
+	writeDiff TarWriter
 }
 
 var emptyDesc = ocispec.Descriptor{}
 var uncompressed = "containerd.io/uncompressed"
 
+// TarWriter generates the tar stream for the diff between lowerRoot and
+// upperRoot and writes it to w.
+type TarWriter func(ctx context.Context, w io.Writer, lowerRoot, upperRoot string) error
+
 // NewWalkingDiff is a generic implementation of diff.Comparer.  The diff is
 // calculated by mounting both the upper and lower mount sets and walking the
 // mounted directories concurrently. Changes are calculated by comparing files
@@ -51,8 +58,18 @@ var uncompressed = "containerd.io/uncompressed"
 // NewWalkingDiff uses no special characteristics of the mount sets and is
 // expected to work with any filesystem.
 func NewWalkingDiff(store content.Store) diff.Comparer {
+	return NewWalkingDiffWithWriter(store, archive.WriteDiff)
+}
+
+// NewWalkingDiffWithWriter is like NewWalkingDiff but allows the caller to
+// replace how the tar stream for the diff itself is produced, while still
+// sharing the mount handling, compression and content-store commit logic of
+// Compare. This lets other packages (such as diff/windows) emit a
+// platform-specific tar stream without duplicating that plumbing.
+func NewWalkingDiffWithWriter(store content.Store, tw TarWriter) diff.Comparer {
 	return &walkingDiff{
-		store: store,
+		store:     store,
+		writeDiff: tw,
 	}
 }
 
@@ -91,22 +108,27 @@ func (s *walkingDiff) Compare(ctx context.Context, lower, upper []mount.Mount, o
 			continue
 		}
 	}
-	var isCompressed bool
+	var ctype compression.Type
 	if config.Compressor != nil {
+		if config.Chunking != nil {
+			return emptyDesc, errors.New("chunking is not supported together with a custom compressor")
+		}
 		if config.MediaType == "" {
 			return emptyDesc, errors.New("media type must be explicitly specified when using custom compressor")
 		}
-		isCompressed = true
+	} else if config.CompressionType != nil {
+		ctype = config.CompressionType
+		if config.MediaType == "" {
+			config.MediaType = ctype.MediaType()
+		}
 	} else {
 		if config.MediaType == "" {
 			config.MediaType = ocispec.MediaTypeImageLayerGzip
 		}
 
-		switch config.MediaType {
-		case ocispec.MediaTypeImageLayer:
-		case ocispec.MediaTypeImageLayerGzip:
-			isCompressed = true
-		default:
+		var ok bool
+		ctype, ok = compression.ByMediaType(config.MediaType)
+		if !ok {
 			return emptyDesc, errors.Wrapf(errdefs.ErrNotImplemented, "unsupported diff media type: %v", config.MediaType)
 		}
 	}
@@ -148,21 +170,35 @@ func (s *walkingDiff) Compare(ctx context.Context, lower, upper []mount.Mount, o
 				}
 			}
 
-			if isCompressed {
-				dgstr := digest.SHA256.Digester()
+			var reporter *progressReporter
+			if config.Progress != nil {
+				reporter = newProgressReporter(lowerRoot, config.Progress)
+			}
+			var target io.Writer = cw
+			if reporter != nil {
+				target = &countingWriter{w: cw, n: &reporter.postCompression}
+			}
+
+			dgstr := digest.SHA256.Digester()
+			var chunkManifest chunked.Manifest
+			if config.Chunking != nil {
+				chunkManifest, errOpen = s.writeChunked(ctx, target, dgstr, lowerRoot, upperRoot, ctype, *config.Chunking, reporter)
+				if errOpen != nil {
+					return errors.Wrap(errOpen, "failed to write chunked diff")
+				}
+
+				if config.Labels == nil {
+					config.Labels = map[string]string{}
+				}
+				config.Labels[uncompressed] = dgstr.Digest().String()
+				config.MediaType = chunked.MediaTypeManifest
+			} else if config.Compressor != nil {
 				var compressed io.WriteCloser
-				if config.Compressor != nil {
-					compressed, errOpen = config.Compressor(cw, config.MediaType)
-					if errOpen != nil {
-						return errors.Wrap(errOpen, "failed to get compressed stream")
-					}
-				} else {
-					compressed, errOpen = compression.CompressStream(cw, compression.Gzip)
-					if errOpen != nil {
-						return errors.Wrap(errOpen, "failed to get compressed stream")
-					}
+				compressed, errOpen = config.Compressor(target, config.MediaType)
+				if errOpen != nil {
+					return errors.Wrap(errOpen, "failed to get compressed stream")
 				}
-				errOpen = archive.WriteDiff(ctx, io.MultiWriter(compressed, dgstr.Hash()), lowerRoot, upperRoot)
+				errOpen = s.runDiff(ctx, io.MultiWriter(compressed, dgstr.Hash()), lowerRoot, upperRoot, reporter)
 				compressed.Close()
 				if errOpen != nil {
 					return errors.Wrap(errOpen, "failed to write compressed diff")
@@ -173,8 +209,26 @@ func (s *walkingDiff) Compare(ctx context.Context, lower, upper []mount.Mount, o
 				}
 				config.Labels[uncompressed] = dgstr.Digest().String()
 			} else {
-				if errOpen = archive.WriteDiff(ctx, cw, lowerRoot, upperRoot); errOpen != nil {
-					return errors.Wrap(errOpen, "failed to write diff")
+				comp, err := ctype.Compress(target)
+				if err != nil {
+					return errors.Wrapf(err, "failed to get %s compressor", config.MediaType)
+				}
+				errOpen = s.runDiff(ctx, io.MultiWriter(comp, dgstr.Hash()), lowerRoot, upperRoot, reporter)
+				if cerr := comp.Close(); errOpen == nil {
+					errOpen = cerr
+				}
+				if errOpen != nil {
+					return errors.Wrap(errOpen, "failed to write compressed diff")
+				}
+
+				if !compression.IsUncompressedType(ctype) {
+					if config.Labels == nil {
+						config.Labels = map[string]string{}
+					}
+					config.Labels[uncompressed] = dgstr.Digest().String()
+				}
+				for k, v := range comp.Labels() {
+					config.Labels[k] = v
 				}
 			}
 
@@ -198,14 +252,31 @@ func (s *walkingDiff) Compare(ctx context.Context, lower, upper []mount.Mount, o
 			if info.Labels == nil {
 				info.Labels = make(map[string]string)
 			}
-			// Set uncompressed label if digest already existed without label
-			if _, ok := info.Labels[uncompressed]; !ok {
+			if config.ForceCompression {
+				// The blob may already have existed under this digest from an
+				// earlier conversion; make sure its labels reflect this
+				// compression scheme instead of silently keeping stale ones.
+				fields := mergeLabels(info.Labels, config.Labels)
+				if len(fields) > 0 {
+					if _, err := s.store.Update(ctx, info, fields...); err != nil {
+						return errors.Wrap(err, "error updating labels")
+					}
+				}
+			} else if _, ok := info.Labels[uncompressed]; !ok {
+				// Set uncompressed label if digest already existed without label
 				info.Labels[uncompressed] = config.Labels[uncompressed]
 				if _, err := s.store.Update(ctx, info, "labels."+uncompressed); err != nil {
 					return errors.Wrap(err, "error setting uncompressed label")
 				}
 			}
 
+			if config.Chunking != nil {
+				chunkLabels := map[string]string{uncompressed: config.Labels[uncompressed]}
+				if err := chunked.LabelChunks(ctx, s.store, chunkManifest, dgst, chunkLabels); err != nil {
+					return errors.Wrap(err, "failed to label chunks")
+				}
+			}
+
 			ocidesc = ocispec.Descriptor{
 				MediaType: config.MediaType,
 				Size:      info.Size,
@@ -220,6 +291,123 @@ func (s *walkingDiff) Compare(ctx context.Context, lower, upper []mount.Mount, o
 	return ocidesc, nil
 }
 
+// writeChunked runs the diff for lowerRoot/upperRoot through a
+// content-defined chunker, writing each resulting chunk to the store as its
+// own blob, and writes the resulting manifest to cw (leaving cw uncommitted
+// for the caller). dgstr accumulates the digest of the pre-compression tar
+// stream, matching the semantics of the non-chunked uncompressed label.
+// reporter, if non-nil, is driven off the pre-compression tar stream as it
+// is walked; the chunked blobs bypass cw entirely, so their sizes are folded
+// into reporter's post-compression count once writing completes.
+func (s *walkingDiff) writeChunked(ctx context.Context, cw io.Writer, dgstr digest.Digester, lowerRoot, upperRoot string, ctype compression.Type, cfg diff.ChunkingConfig, reporter *progressReporter) (chunked.Manifest, error) {
+	pr, pw := io.Pipe()
+
+	writeErrCh := make(chan error, 1)
+	go func() {
+		var out io.Writer = io.MultiWriter(pw, dgstr.Hash())
+		var comp compression.Compressor
+		if ctype != nil {
+			var err error
+			comp, err = ctype.Compress(pw)
+			if err != nil {
+				pw.CloseWithError(err)
+				writeErrCh <- err
+				return
+			}
+			out = io.MultiWriter(comp, dgstr.Hash())
+		}
+
+		err := s.runDiff(ctx, out, lowerRoot, upperRoot, reporter)
+		if comp != nil {
+			if cerr := comp.Close(); err == nil {
+				err = cerr
+			}
+		}
+		if err != nil {
+			pw.CloseWithError(err)
+		} else {
+			pw.Close()
+		}
+		writeErrCh <- err
+	}()
+
+	manifest, err := chunked.Write(ctx, s.store, pr, cfg.MinSize, cfg.AvgSize, cfg.MaxSize, nil)
+
+	// chunked.Write already closes pr with its own error on failure, which
+	// unblocks the producer goroutine above; but if the producer is instead
+	// stuck writing the diff itself (e.g. a slow walk with no content-store
+	// error to propagate), wait for ctx to end the wait rather than hanging
+	// here forever, closing pr ourselves to unblock the goroutine.
+	var werr error
+	select {
+	case werr = <-writeErrCh:
+	case <-ctx.Done():
+		pr.CloseWithError(ctx.Err())
+		werr = <-writeErrCh
+	}
+	if werr != nil {
+		return chunked.Manifest{}, werr
+	}
+	if err != nil {
+		return chunked.Manifest{}, err
+	}
+
+	manifestBytes, err := manifest.Marshal()
+	if err != nil {
+		return chunked.Manifest{}, errors.Wrap(err, "failed to marshal chunk manifest")
+	}
+	if _, err := cw.Write(manifestBytes); err != nil {
+		return chunked.Manifest{}, errors.Wrap(err, "failed to write chunk manifest")
+	}
+
+	if reporter != nil {
+		var total int64
+		for _, chunk := range manifest.Chunks {
+			total += chunk.Size
+		}
+		atomic.AddInt64(&reporter.postCompression, total)
+		reporter.report()
+	}
+
+	return manifest, nil
+}
+
+// runDiff writes the diff for lowerRoot/upperRoot to target via writeDiff,
+// optionally tee-ing the stream through reporter for progress callbacks. It
+// also surfaces ctx.Err() when the write itself reports no error, so that a
+// caller canceled mid-diff reliably aborts the in-progress content write
+// instead of committing a partial ref.
+func (s *walkingDiff) runDiff(ctx context.Context, target io.Writer, lowerRoot, upperRoot string, reporter *progressReporter) error {
+	w := target
+	var tee io.WriteCloser
+	if reporter != nil {
+		tee = reporter.wrap(target)
+		w = tee
+	}
+
+	err := s.writeDiff(ctx, w, lowerRoot, upperRoot)
+	if tee != nil {
+		if cerr := tee.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	return err
+}
+
+// mergeLabels copies each key/value from src into dst and returns the
+// "labels.<key>" field paths needed to persist them via content.Store.Update.
+func mergeLabels(dst, src map[string]string) []string {
+	var fields []string
+	for k, v := range src {
+		dst[k] = v
+		fields = append(fields, "labels."+k)
+	}
+	return fields
+}
+
 func uniqueRef() string {
 	t := time.Now()
 	var b [3]byte
@@ -0,0 +1,117 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package walking
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sort"
+	"testing"
+
+	"github.com/containerd/containerd/diff"
+)
+
+func TestMergeLabels(t *testing.T) {
+	dst := map[string]string{"containerd.io/uncompressed": "stale"}
+	src := map[string]string{
+		"containerd.io/uncompressed": "fresh",
+		"containerd.io/other":        "value",
+	}
+
+	fields := mergeLabels(dst, src)
+
+	if dst["containerd.io/uncompressed"] != "fresh" {
+		t.Errorf("dst[uncompressed] = %q, want %q", dst["containerd.io/uncompressed"], "fresh")
+	}
+	if dst["containerd.io/other"] != "value" {
+		t.Errorf("dst[other] = %q, want %q", dst["containerd.io/other"], "value")
+	}
+
+	sort.Strings(fields)
+	want := []string{"labels.containerd.io/other", "labels.containerd.io/uncompressed"}
+	if len(fields) != len(want) {
+		t.Fatalf("fields = %v, want %v", fields, want)
+	}
+	for i := range want {
+		if fields[i] != want[i] {
+			t.Errorf("fields[%d] = %q, want %q", i, fields[i], want[i])
+		}
+	}
+}
+
+func TestMergeLabelsEmptySrc(t *testing.T) {
+	dst := map[string]string{"a": "b"}
+	fields := mergeLabels(dst, nil)
+	if fields != nil {
+		t.Errorf("fields = %v, want nil", fields)
+	}
+	if dst["a"] != "b" {
+		t.Errorf("dst mutated unexpectedly: %v", dst)
+	}
+}
+
+func TestRunDiffSurfacesCancellation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	s := &walkingDiff{
+		writeDiff: func(ctx context.Context, w io.Writer, lowerRoot, upperRoot string) error {
+			return nil
+		},
+	}
+
+	err := s.runDiff(ctx, io.Discard, "", "", nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("runDiff() error = %v, want context.Canceled", err)
+	}
+}
+
+func TestRunDiffReturnsWriteDiffError(t *testing.T) {
+	wantErr := errors.New("boom")
+	s := &walkingDiff{
+		writeDiff: func(ctx context.Context, w io.Writer, lowerRoot, upperRoot string) error {
+			return wantErr
+		},
+	}
+
+	err := s.runDiff(context.Background(), io.Discard, "", "", nil)
+	if !errors.Is(err, wantErr) {
+		t.Fatalf("runDiff() error = %v, want %v", err, wantErr)
+	}
+}
+
+func TestRunDiffReportsProgressOnClose(t *testing.T) {
+	var reported bool
+	reporter := newProgressReporter(t.TempDir(), func(update diff.ProgressUpdate) {
+		reported = true
+	})
+
+	s := &walkingDiff{
+		writeDiff: func(ctx context.Context, w io.Writer, lowerRoot, upperRoot string) error {
+			_, err := w.Write([]byte("not a tar stream, just exercising the tee"))
+			return err
+		},
+	}
+
+	if err := s.runDiff(context.Background(), io.Discard, "", "", reporter); err != nil {
+		t.Fatalf("runDiff() error = %v", err)
+	}
+	if !reported {
+		t.Error("expected at least one progress update from the reporter's Close")
+	}
+}
@@ -0,0 +1,163 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package walking
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/containerd/containerd/diff"
+)
+
+const (
+	whiteoutPrefix         = ".wh."
+	progressReportInterval = 200 * time.Millisecond
+)
+
+// progressReporter drives a diff.Progress callback off of the tar stream
+// produced for a Compare. The callback runs on the goroutine writing the
+// diff, and each write waits until the background tar parser has read the
+// same bytes, so a slow callback or parser slows the diff down.
+type progressReporter struct {
+	onUpdate  diff.Progress
+	lowerRoot string
+
+	preCompression  int64
+	postCompression int64
+	added           int64
+	changed         int64
+	deleted         int64
+	currentPath     atomic.Value
+
+	lastReport time.Time
+}
+
+func newProgressReporter(lowerRoot string, onUpdate diff.Progress) *progressReporter {
+	r := &progressReporter{lowerRoot: lowerRoot, onUpdate: onUpdate}
+	r.currentPath.Store("")
+	return r
+}
+
+// countingWriter forwards writes to w while accumulating their total size
+// into n, so callers can observe how many bytes have actually landed in the
+// content store.
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	written, err := c.w.Write(p)
+	atomic.AddInt64(c.n, int64(written))
+	return written, err
+}
+
+// wrap returns an io.WriteCloser that forwards every write to dest and,
+// concurrently, feeds a background goroutine parsing the same bytes as a
+// tar stream to keep the reporter's per-file counters current. Close must
+// be called once writing is done; it blocks until the background goroutine
+// has drained and reports a final update.
+func (r *progressReporter) wrap(dest io.Writer) io.WriteCloser {
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.consume(pr)
+	}()
+	return &progressTeeWriter{dest: dest, pw: pw, done: done, reporter: r}
+}
+
+type progressTeeWriter struct {
+	dest     io.Writer
+	pw       *io.PipeWriter
+	done     chan struct{}
+	reporter *progressReporter
+}
+
+func (w *progressTeeWriter) Write(p []byte) (int, error) {
+	n, err := w.dest.Write(p)
+	if n > 0 {
+		// Best-effort: a write error here only means progress reporting
+		// falls behind, it must never fail the diff itself.
+		w.pw.Write(p[:n])
+		atomic.AddInt64(&w.reporter.preCompression, int64(n))
+		w.reporter.maybeReport()
+	}
+	return n, err
+}
+
+func (w *progressTeeWriter) Close() error {
+	w.pw.Close()
+	<-w.done
+	w.reporter.report()
+	return nil
+}
+
+func (r *progressReporter) consume(pr *io.PipeReader) {
+	tr := tar.NewReader(pr)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			io.Copy(io.Discard, pr)
+			return
+		}
+
+		r.currentPath.Store(hdr.Name)
+		switch {
+		case strings.HasPrefix(filepath.Base(hdr.Name), whiteoutPrefix):
+			atomic.AddInt64(&r.deleted, 1)
+		default:
+			if _, err := os.Lstat(filepath.Join(r.lowerRoot, hdr.Name)); err != nil {
+				atomic.AddInt64(&r.added, 1)
+			} else {
+				atomic.AddInt64(&r.changed, 1)
+			}
+		}
+		io.Copy(io.Discard, tr)
+	}
+}
+
+// maybeReport reports progress if progressReportInterval has elapsed since
+// the last report. It is only ever called from the single goroutine writing
+// to the tee, so lastReport needs no synchronization of its own.
+func (r *progressReporter) maybeReport() {
+	if now := time.Now(); now.Sub(r.lastReport) >= progressReportInterval {
+		r.lastReport = now
+		r.report()
+	}
+}
+
+func (r *progressReporter) report() {
+	if r.onUpdate == nil {
+		return
+	}
+	path, _ := r.currentPath.Load().(string)
+	r.onUpdate(diff.ProgressUpdate{
+		BytesWalked:                 atomic.LoadInt64(&r.preCompression),
+		BytesWrittenPreCompression:  atomic.LoadInt64(&r.preCompression),
+		BytesWrittenPostCompression: atomic.LoadInt64(&r.postCompression),
+		FilesAdded:                  int(atomic.LoadInt64(&r.added)),
+		FilesChanged:                int(atomic.LoadInt64(&r.changed)),
+		FilesDeleted:                int(atomic.LoadInt64(&r.deleted)),
+		CurrentPath:                 path,
+	})
+}
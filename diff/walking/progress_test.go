@@ -0,0 +1,113 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package walking
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/diff"
+)
+
+// buildTar writes a minimal tar stream with the given entries (name plus
+// file content; a name whose base is prefixed with whiteoutPrefix gets no
+// content, matching how a real diff tar represents deletions).
+func buildTar(t *testing.T, names ...string) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range names {
+		content := []byte("hello")
+		if strings.HasPrefix(filepath.Base(name), whiteoutPrefix) {
+			content = nil
+		}
+		hdr := &tar.Header{Name: name, Size: int64(len(content)), Mode: 0644}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("WriteHeader(%s): %v", name, err)
+		}
+		if len(content) > 0 {
+			if _, err := tw.Write(content); err != nil {
+				t.Fatalf("Write(%s): %v", name, err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("tar Close: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestProgressReporterTracksAddedChangedDeleted(t *testing.T) {
+	lowerRoot := t.TempDir()
+	if err := os.WriteFile(filepath.Join(lowerRoot, "changed.txt"), []byte("old"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	tarBytes := buildTar(t, "added.txt", "changed.txt", whiteoutPrefix+"deleted.txt")
+
+	var updates []diff.ProgressUpdate
+	reporter := newProgressReporter(lowerRoot, func(update diff.ProgressUpdate) {
+		updates = append(updates, update)
+	})
+
+	var dest bytes.Buffer
+	w := reporter.wrap(&dest)
+	if _, err := w.Write(tarBytes); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if !bytes.Equal(dest.Bytes(), tarBytes) {
+		t.Error("wrap() did not forward all bytes to dest unchanged")
+	}
+	if len(updates) == 0 {
+		t.Fatal("expected at least one progress update")
+	}
+
+	final := updates[len(updates)-1]
+	if final.FilesAdded != 1 {
+		t.Errorf("FilesAdded = %d, want 1", final.FilesAdded)
+	}
+	if final.FilesChanged != 1 {
+		t.Errorf("FilesChanged = %d, want 1", final.FilesChanged)
+	}
+	if final.FilesDeleted != 1 {
+		t.Errorf("FilesDeleted = %d, want 1", final.FilesDeleted)
+	}
+	if final.BytesWrittenPreCompression != int64(len(tarBytes)) {
+		t.Errorf("BytesWrittenPreCompression = %d, want %d", final.BytesWrittenPreCompression, len(tarBytes))
+	}
+}
+
+func TestProgressReporterNilOnUpdateDoesNotPanic(t *testing.T) {
+	reporter := newProgressReporter(t.TempDir(), nil)
+	w := reporter.wrap(io.Discard)
+	if _, err := w.Write(buildTar(t, "a.txt")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
@@ -0,0 +1,68 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package windows
+
+import (
+	"archive/tar"
+	"encoding/base64"
+	"fmt"
+	"os"
+
+	"github.com/Microsoft/go-winio"
+	"golang.org/x/sys/windows"
+)
+
+// addWindowsAttrs stats path on an NTFS volume and records its file
+// attribute bitmask, raw security descriptor and creation time as PAX
+// records on hdr. It is a no-op (not an error) for entries that no longer
+// exist on disk, such as whiteout markers for deleted files.
+func addWindowsAttrs(hdr *tar.Header, path string) error {
+	p, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return err
+	}
+	attr, err := windows.GetFileAttributes(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	if hdr.PAXRecords == nil {
+		hdr.PAXRecords = make(map[string]string)
+	}
+	hdr.PAXRecords["MSWINDOWS.fileattr"] = fmt.Sprintf("%x", attr)
+
+	if sd, err := winio.GetFileSecurityDescriptor(path); err == nil {
+		hdr.PAXRecords["MSWINDOWS.rawsd"] = base64.StdEncoding.EncodeToString(sd)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	bi, err := winio.GetFileBasicInfo(f)
+	if err == nil {
+		ct := bi.CreationTime.Time()
+		hdr.PAXRecords["LIBARCHIVE.creationtime"] = fmt.Sprintf("%d.%d", ct.Unix(), ct.Nanosecond())
+	}
+
+	return nil
+}
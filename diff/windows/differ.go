@@ -0,0 +1,111 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package windows provides a diff.Comparer wrapper that can emit
+// Windows-layer-compatible tar output.
+package windows
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"path/filepath"
+
+	"github.com/containerd/containerd/archive"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/diff"
+	"github.com/containerd/containerd/diff/walking"
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/pkg/winlayers"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+type windowsDiffer struct {
+	inner diff.Comparer
+	store content.Store
+}
+
+// NewWalkingDiffWithWindows returns a diff.Comparer which behaves exactly
+// like inner (typically a walking.NewWalkingDiff) except when
+// winlayers.UseWindowsLayerMode(ctx) is set on the Compare context, in which
+// case inner is not used: a walking differ over store (see
+// walking.NewWalkingDiffWithWriter) supplies the mount, compression and
+// commit plumbing and produces a tar stream carrying Windows-specific PAX headers (file
+// attributes, security descriptor, creation time) so the resulting layer
+// can be consumed by Windows container runtimes.
+func NewWalkingDiffWithWindows(store content.Store, inner diff.Comparer) diff.Comparer {
+	return &windowsDiffer{
+		inner: inner,
+		store: store,
+	}
+}
+
+func (d *windowsDiffer) Compare(ctx context.Context, lower, upper []mount.Mount, opts ...diff.Opt) (ocispec.Descriptor, error) {
+	if !winlayers.UseWindowsLayerMode(ctx) {
+		return d.inner.Compare(ctx, lower, upper, opts...)
+	}
+	return walking.NewWalkingDiffWithWriter(d.store, writeWindowsDiff).Compare(ctx, lower, upper, opts...)
+}
+
+// writeWindowsDiff writes the same entries archive.WriteDiff would produce
+// for lowerRoot/upperRoot, but with MSWINDOWS.* and LIBARCHIVE.* PAX records
+// added to each added or changed entry that still exists in upperRoot.
+func writeWindowsDiff(ctx context.Context, w io.Writer, lowerRoot, upperRoot string) error {
+	pr, pw := io.Pipe()
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- archive.WriteDiff(ctx, pw, lowerRoot, upperRoot)
+		pw.Close()
+	}()
+
+	tr := tar.NewReader(pr)
+	tw := tar.NewWriter(w)
+
+	injectErr := func() error {
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			if err := addWindowsAttrs(hdr, filepath.Join(upperRoot, hdr.Name)); err != nil {
+				return errors.Wrapf(err, "failed to read windows attributes for %s", hdr.Name)
+			}
+
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			if _, err := io.Copy(tw, tr); err != nil {
+				return err
+			}
+		}
+	}()
+
+	if injectErr != nil {
+		pr.CloseWithError(injectErr)
+		<-errCh
+		return injectErr
+	}
+	if err := <-errCh; err != nil {
+		return err
+	}
+	return tw.Close()
+}
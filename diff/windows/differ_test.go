@@ -0,0 +1,80 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package windows
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWriteWindowsDiffPropagatesMissingRoots(t *testing.T) {
+	done := make(chan error, 1)
+	go func() {
+		done <- writeWindowsDiff(context.Background(), io.Discard, filepath.Join(t.TempDir(), "no-such-lower"), filepath.Join(t.TempDir(), "no-such-upper"))
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("expected an error for nonexistent lower/upper roots, got nil")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("writeWindowsDiff did not return within 5s; producer goroutine likely deadlocked on the pipe")
+	}
+}
+
+func TestWriteWindowsDiffSucceedsForAddedFile(t *testing.T) {
+	lowerRoot := t.TempDir()
+	upperRoot := t.TempDir()
+	if err := os.WriteFile(filepath.Join(upperRoot, "file.txt"), []byte("hi"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- writeWindowsDiff(context.Background(), io.Discard, lowerRoot, upperRoot)
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("writeWindowsDiff() error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("writeWindowsDiff did not return within 5s")
+	}
+}
+
+func TestWriteWindowsDiffCancellationDoesNotHang(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- writeWindowsDiff(ctx, io.Discard, t.TempDir(), t.TempDir())
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("writeWindowsDiff did not return within 5s for a pre-canceled context; producer goroutine likely deadlocked on the pipe")
+	}
+}
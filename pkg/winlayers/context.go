@@ -0,0 +1,38 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package winlayers carries a context flag requesting that layer diffs be
+// produced in a form consumable by Windows container runtimes.
+package winlayers
+
+import "context"
+
+type windowsLayerModeKey struct{}
+
+// WithWindowsLayerMode returns a context which signals to a differ that it
+// should emit Windows-layer-compatible tar output, for example NTFS
+// metadata recorded as PAX headers, instead of the default POSIX-oriented
+// diff.
+func WithWindowsLayerMode(ctx context.Context) context.Context {
+	return context.WithValue(ctx, windowsLayerModeKey{}, true)
+}
+
+// UseWindowsLayerMode reports whether ctx was marked via
+// WithWindowsLayerMode.
+func UseWindowsLayerMode(ctx context.Context) bool {
+	v, ok := ctx.Value(windowsLayerModeKey{}).(bool)
+	return ok && v
+}